@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// AMIInfo is the AMI metadata we persist, keyed by AMI-id. Creation
+// dates (and the rest of this data) never change for a given AMI, so
+// once fetched it can be cached on disk indefinitely, subject to TTL.
+type AMIInfo struct {
+	CreationDate    string
+	Name            string
+	OwnerID         string
+	DeprecationTime string
+	FetchedAt       time.Time
+}
+
+// amiCache is a TTL'd, on-disk cache of AMIInfo, keyed by AMI-id. It
+// is safe for concurrent use by the worker pool.
+type amiCache struct {
+	lock    sync.RWMutex
+	path    string
+	ttl     time.Duration
+	entries map[string]AMIInfo
+}
+
+// defaultAMICachePath returns $XDG_CACHE_HOME/aws-list/amis.json,
+// falling back to ~/.cache/aws-list/amis.json when XDG_CACHE_HOME is
+// unset.
+func defaultAMICachePath() string {
+
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			dir = filepath.Join(home, ".cache")
+		}
+	}
+	return filepath.Join(dir, "aws-list", "amis.json")
+}
+
+// loadAMICache reads the cache file at path, if it exists, and
+// returns a ready-to-use amiCache with the given TTL.
+func loadAMICache(path string, ttl time.Duration) (*amiCache, error) {
+
+	c := &amiCache{path: path, ttl: ttl, entries: map[string]AMIInfo{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the cached AMIInfo for id, if present and not yet
+// expired.
+func (c *amiCache) Get(id string) (AMIInfo, bool) {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	info, ok := c.entries[id]
+	if !ok {
+		return AMIInfo{}, false
+	}
+	if c.ttl > 0 && time.Since(info.FetchedAt) > c.ttl {
+		return AMIInfo{}, false
+	}
+	return info, true
+}
+
+// Put stores the AMIInfo for id.
+func (c *amiCache) Put(id string, info AMIInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[id] = info
+}
+
+// Save writes the cache back to disk, creating its parent directory
+// if required.
+func (c *amiCache) Save() error {
+
+	c.lock.RLock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0o644)
+}
+
+// amiInfoForIDs resolves AMIInfo for every id in ids, consulting the
+// cache first and issuing a single bulk DescribeImages call for
+// whatever remains - rather than one DescribeImages call per
+// instance, which is what throttles large accounts.
+func amiInfoForIDs(ctx context.Context, svc *ec2.Client, cache *amiCache, ids []string) (map[string]AMIInfo, error) {
+
+	result := map[string]AMIInfo{}
+	missing := []string{}
+
+	for _, id := range ids {
+		if info, ok := cache.Get(id); ok {
+			result[id] = info
+			continue
+		}
+		missing = append(missing, id)
+	}
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	out, err := svc.DescribeImages(ctx, &ec2.DescribeImagesInput{ImageIds: missing})
+	if err != nil {
+		return nil, fmt.Errorf("error getting image info: %s", err.Error())
+	}
+
+	now := time.Now()
+	for _, img := range out.Images {
+		info := AMIInfo{
+			CreationDate:    aws.ToString(img.CreationDate),
+			Name:            aws.ToString(img.Name),
+			OwnerID:         aws.ToString(img.OwnerId),
+			DeprecationTime: aws.ToString(img.DeprecationTime),
+			FetchedAt:       now,
+		}
+		id := aws.ToString(img.ImageId)
+		cache.Put(id, info)
+		result[id] = info
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Filter describes the policy a record must violate in order to be
+// considered a "match" by -fail-on-match. Every condition that is set
+// must hold for an Instance to match. An empty Filter has no condition
+// set (see Active): Matches returns true for it, and filteringReporter
+// then forwards every record without counting any as a match.
+type Filter struct {
+	MinAgeDays int
+	NameMatch  *regexp.Regexp
+	AMIMatch   *regexp.Regexp
+	Tags       map[string]string
+}
+
+// Active reports whether any condition has actually been configured.
+func (f Filter) Active() bool {
+	return f.MinAgeDays > 0 || f.NameMatch != nil || f.AMIMatch != nil || len(f.Tags) > 0
+}
+
+// Matches reports whether the given Instance satisfies every
+// configured condition in the Filter.
+func (f Filter) Matches(i Instance) bool {
+
+	if f.MinAgeDays > 0 && i.AMIAgeDays < f.MinAgeDays {
+		return false
+	}
+	if f.NameMatch != nil && !f.NameMatch.MatchString(i.Name) {
+		return false
+	}
+	if f.AMIMatch != nil && !f.AMIMatch.MatchString(i.AMI) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if i.Tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// tagFlag collects repeated `-tag=Key=Value` flags into a map.
+type tagFlag map[string]string
+
+func (t tagFlag) String() string {
+	parts := []string{}
+	for k, v := range t {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, v))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (t tagFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected -tag=Key=Value, got %q", value)
+	}
+	t[kv[0]] = kv[1]
+	return nil
+}
+
+// filteringReporter wraps another Reporter, forwarding only the
+// records which match its Filter (or every record, when the Filter is
+// not Active), and keeping a running count of how
+// many matches it has seen so -fail-on-match can report a non-zero
+// exit code once the scan has finished.
+type filteringReporter struct {
+	next    Reporter
+	filter  Filter
+	matched int64
+}
+
+func newFilteringReporter(next Reporter, filter Filter) *filteringReporter {
+	return &filteringReporter{next: next, filter: filter}
+}
+
+func (f *filteringReporter) Report(i Instance) error {
+
+	if !f.filter.Active() {
+		return f.next.Report(i)
+	}
+
+	if !f.filter.Matches(i) {
+		return nil
+	}
+
+	atomic.AddInt64(&f.matched, 1)
+	return f.next.Report(i)
+}
+
+// Matched returns the number of records which matched the filter.
+func (f *filteringReporter) Matched() int64 {
+	return atomic.LoadInt64(&f.matched)
+}
+
+// Flush delegates to the wrapped Reporter, if it buffers output.
+func (f *filteringReporter) Flush() error {
+	if flusher, ok := f.next.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
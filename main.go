@@ -11,195 +11,408 @@
 //
 //    $ aws-list
 //
-//  Export all instances, across the roles in the given text-file
+//  Export all instances, across the roles in the given text-file. Each
+//  line is TSV: arn<TAB>region<TAB>external_id<TAB>mfa_serial<TAB>
+//  session_name<TAB>profile - only the ARN is required.
 //
 //    $ aws-list -role=foo.list
+//
+//  Export all instances, across every EC2-enabled region:
+//
+//    $ aws-list -regions=all
+//
+//  Export all instances, across a specific set of regions:
+//
+//    $ aws-list -regions=us-east-1,eu-west-1
+//
+//  Export all instances as JSON, one object per line:
+//
+//    $ aws-list -format=json
+//
+//  Fail CI if any instance is running an AMI more than 180 days old:
+//
+//    $ aws-list -min-age-days=180 -fail-on-match
+//
+// AMI metadata is cached on disk under $XDG_CACHE_HOME/aws-list, since
+// it never changes; pass -ami-cache-ttl=0 to trust it forever.
 
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
-// Cache of creation-time/date
-var cache map[string]string
-
-// Get the creation-date of the given AMI.
-//
-// Values are cached.
-func amiCreation(svc *ec2.EC2, id string) (string, error) {
-
-	// Lookup in the cache to see if we've already found the creation
-	// date for this AMI
-	cached, ok := cache[id]
-	if ok {
-		return cached, nil
-	}
-
-	// Setup a filter for the AMI we're looking for.
-	input := &ec2.DescribeImagesInput{
-		ImageIds: []*string{
-			aws.String(id),
-		},
-	}
+// allRegions returns the names of every region in which EC2 is
+// enabled, as seen by the given EC2 client.
+func allRegions(ctx context.Context, svc *ec2.Client) ([]string, error) {
 
-	// Run the search
-	result, err := svc.DescribeImages(input)
+	out, err := svc.DescribeRegions(ctx, &ec2.DescribeRegionsInput{})
 	if err != nil {
-		// Message from an error.
-		return "", fmt.Errorf("error getting image info: %s", err.Error())
+		return nil, fmt.Errorf("DescribeRegions failed: %s", err)
 	}
 
-	// If we got a result then we can return the creation time
-	// (as a string)
-	if len(result.Images) > 0 {
-
-		// But save in a cache for the future
-		date := *result.Images[0].CreationDate
-		cache[id] = date
-		return date, nil
+	regions := []string{}
+	for _, r := range out.Regions {
+		regions = append(regions, aws.ToString(r.RegionName))
 	}
-	return "", fmt.Errorf("no date for %s", id)
+	return regions, nil
 }
 
-// Sync from remote to local
-func Sync(svc *ec2.EC2, acct string) error {
+// Sync from remote to local, for the given account, in the given region,
+// writing each instance it finds to the given Reporter. AMI metadata
+// is resolved via amiCache, batching lookups across the whole pass
+// rather than issuing one DescribeImages call per instance.
+func Sync(ctx context.Context, svc *ec2.Client, acct string, region string, reporter Reporter, cache *amiCache) error {
 
 	// Get the instances which are running/pending
 	params := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
+		Filters: []ec2types.Filter{
 			{
 				Name:   aws.String("instance-state-name"),
-				Values: []*string{aws.String("running"), aws.String("pending")},
+				Values: []string{"running", "pending"},
 			},
 		},
 	}
 
-	// Create new EC2 client
-	result, err := svc.DescribeInstances(params)
+	// Walk every page of results, buffering them all up-front, so
+	// accounts with more instances than fit in a single response are
+	// handled correctly, and so we can batch the AMI lookups below.
+	instances := []ec2types.Instance{}
+	paginator := ec2.NewDescribeInstancesPaginator(svc, params)
+	for paginator.HasMorePages() {
+
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("DescribeInstances failed: %s", err)
+		}
+
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+	}
+
+	//
+	// Collect the unique AMI-ids seen in this pass, and resolve them
+	// all in a single bulk call (for whatever isn't already cached).
+	//
+	seen := map[string]bool{}
+	amiIDs := []string{}
+	for _, instance := range instances {
+		ami := aws.ToString(instance.ImageId)
+		if !seen[ami] {
+			seen[ami] = true
+			amiIDs = append(amiIDs, ami)
+		}
+	}
+
+	amis, err := amiInfoForIDs(ctx, svc, cache, amiIDs)
 	if err != nil {
-		return fmt.Errorf("DescribeInstances failed: %s", err)
+		return err
 	}
 
 	// For each instance show stuff
-	for _, reservation := range result.Reservations {
-		for _, instance := range reservation.Instances {
+	for _, instance := range instances {
+
+		// We have a running EC2 instnace.
+
+		// Collect the data we want
+		id := aws.ToString(instance.InstanceId)
+
+		// Find the name.
+		name := id
+
+		// Look for the name, which is set via a Tag.
+		for _, tag := range instance.Tags {
+			if aws.ToString(tag.Key) == "Name" {
+				name = aws.ToString(tag.Value)
+			}
+		}
+
+		// AMI name
+		ami := aws.ToString(instance.ImageId)
+
+		//
+		// Get the AMI creation-date
+		//
+		info, ok := amis[ami]
+		if !ok {
+			return fmt.Errorf("failed to get creation date of %s: no such image", ami)
+		}
+
+		//
+		// Parse the date, so we can report how many days
+		// ago the AMI was created.
+		//
+		t, err := time.Parse("2006-01-02T15:04:05.000Z", info.CreationDate)
+		if err != nil {
+			return fmt.Errorf("failed to parse time string %s: %s", info.CreationDate, err)
+		}
+
+		//
+		// Count how old the AMI is in days
+		//
+		date := time.Now()
+		diff := date.Sub(t)
+		ageDays := int(diff.Hours() / 24)
+
+		//
+		// Collect the tags into a simple map.
+		//
+		tags := map[string]string{}
+		for _, tag := range instance.Tags {
+			tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
 
-			// We have a running EC2 instnace.
+		//
+		// Report all of the information we've gathered.
+		//
+		record := Instance{
+			Account:         acct,
+			InstanceID:      id,
+			Name:            name,
+			AMI:             ami,
+			AMICreationDate: info.CreationDate,
+			AMIAgeDays:      ageDays,
+			Region:          region,
+			InstanceType:    string(instance.InstanceType),
+			State:           string(instance.State.Name),
+			PrivateIP:       aws.ToString(instance.PrivateIpAddress),
+			PublicIP:        aws.ToString(instance.PublicIpAddress),
+			LaunchTime:      aws.ToTime(instance.LaunchTime),
+			Tags:            tags,
+		}
+		if err := reporter.Report(record); err != nil {
+			return fmt.Errorf("failed to report instance %s: %s", id, err.Error())
+		}
+	}
+	return nil
+}
 
-			// Collect the data we want
-			id := *instance.InstanceId
+// scanTask describes a single (account, region) pair to be scanned
+// by a worker in the pool.
+type scanTask struct {
+	acct   string
+	region string
+	cfg    aws.Config
+}
 
-			// Find the name.
-			name := *instance.InstanceId
+// runPool fans tasks out across a bounded number of worker goroutines,
+// running Sync for each (account, region) pair and writing every
+// instance found to the given Reporter, returning the first error
+// encountered (if any).
+func runPool(ctx context.Context, tasks []scanTask, parallel int, reporter Reporter, cache *amiCache) error {
 
-			// Look for the name, which is set via a Tag.
-			i := 0
-			for i < len(instance.Tags) {
+	if parallel < 1 {
+		parallel = 1
+	}
 
-				if *instance.Tags[i].Key == "Name" {
-					name = *instance.Tags[i].Value
+	jobs := make(chan scanTask)
+	errs := make(chan error, len(tasks))
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range jobs {
+				svc := ec2.NewFromConfig(task.cfg)
+				if err := Sync(ctx, svc, task.acct, task.region, reporter, cache); err != nil {
+					errs <- fmt.Errorf("error syncing account %s region %s: %s", task.acct, task.region, err)
 				}
-				i++
 			}
+		}()
+	}
 
-			// AMI name
-			ami := *instance.ImageId
+	for _, task := range tasks {
+		jobs <- task
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for e := range errs {
+		fmt.Println(e.Error())
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
 
-			//
-			// Get the AMI creation-date
-			//
-			create, err := amiCreation(svc, ami)
-			if err != nil {
-				return fmt.Errorf("failed to get creation date of %s: %s", ami, err.Error())
-			}
+// regionsForAccount resolves the `-regions` flag into a concrete list
+// of region-names to scan, using the given per-account config to
+// discover them when `-regions=all` is requested. With no `-regions`
+// flag it falls back to whatever region is already set on cfg (the
+// role's own region, if the role-file specified one).
+func regionsForAccount(ctx context.Context, regionsPtr string, cfg aws.Config) ([]string, error) {
 
-			//
-			// Parse the date, so we can report how many days
-			// ago the AMI was created.
-			//
-			t, err := time.Parse("2006-01-02T15:04:05.000Z", create)
-			if err != nil {
-				return fmt.Errorf("failed to parse time string %s: %s", create, err)
-			}
+	if regionsPtr == "" {
+		return []string{cfg.Region}, nil
+	}
 
-			//
-			// Count how old the AMI is in days
-			//
-			date := time.Now()
-			diff := date.Sub(t)
-			create = fmt.Sprintf("%d days", (int(diff.Hours() / 24)))
-
-			//
-			// Now show all the information
-			//
-			fmt.Printf("%s %s %s %s %s\n", acct, id, name, ami, create)
+	if regionsPtr == "all" {
+		return allRegions(ctx, ec2.NewFromConfig(cfg))
+	}
+
+	parts := strings.Split(regionsPtr, ",")
+	regions := []string{}
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			regions = append(regions, p)
 		}
 	}
-	return nil
+	return regions, nil
+}
+
+// cfgForRegion returns a copy of cfg pinned to the given region, so
+// each worker in the pool talks to the right regional endpoint.
+func cfgForRegion(cfg aws.Config, region string) aws.Config {
+	out := cfg.Copy()
+	out.Region = region
+	return out
 }
 
 func main() {
 
-	//
-	// Create our cache
-	//
-	cache = make(map[string]string)
+	// Allow Ctrl-C to cancel any in-flight AWS calls cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
 	//
 	// Command-line flags
 	//
 	rolePtr := flag.String("roles", "", "Specify the path to a file containing AWS-roles to assume, one per line")
+	regionsPtr := flag.String("regions", "", "Comma-separated list of regions to scan, or 'all' to scan every EC2-enabled region")
+	parallelPtr := flag.Int("parallel", 4, "Number of (account, region) pairs to scan concurrently")
+	formatPtr := flag.String("format", "text", "Output format: text, json, csv or table")
+	minAgeDaysPtr := flag.Int("min-age-days", 0, "Only match instances whose AMI is at least this many days old")
+	nameMatchPtr := flag.String("name-match", "", "Only match instances whose Name tag matches this regular expression")
+	amiMatchPtr := flag.String("ami-match", "", "Only match instances whose AMI-id matches this regular expression")
+	failOnMatchPtr := flag.Bool("fail-on-match", false, "Exit with a non-zero status if any instance matches the filters")
+	amiCacheTTLPtr := flag.Duration("ami-cache-ttl", 720*time.Hour, "How long to trust the on-disk AMI metadata cache for")
+	tags := tagFlag{}
+	flag.Var(tags, "tag", "Only match instances with this Key=Value tag (may be repeated)")
 
 	//
 	// Parse flags
 	//
 	flag.Parse()
 
+	//
+	// Load the persistent AMI cache - AMI metadata never changes, so
+	// there's no point re-fetching it on every run.
+	//
+	cache, err := loadAMICache(defaultAMICachePath(), *amiCacheTTLPtr)
+	if err != nil {
+		fmt.Printf("error loading AMI cache: %s\n", err.Error())
+		return
+	}
+
+	//
+	// Build the filter which decides which instances are "matches"
+	// for the purposes of -fail-on-match.
+	//
+	filter := Filter{MinAgeDays: *minAgeDaysPtr, Tags: tags}
+	if *nameMatchPtr != "" {
+		re, rerr := regexp.Compile(*nameMatchPtr)
+		if rerr != nil {
+			fmt.Printf("invalid -name-match regular expression: %s\n", rerr.Error())
+			return
+		}
+		filter.NameMatch = re
+	}
+	if *amiMatchPtr != "" {
+		re, rerr := regexp.Compile(*amiMatchPtr)
+		if rerr != nil {
+			fmt.Printf("invalid -ami-match regular expression: %s\n", rerr.Error())
+			return
+		}
+		filter.AMIMatch = re
+	}
+
+	//
+	// Build the reporter which will receive every instance we find,
+	// wrapped so that only instances matching the filter (if any) are
+	// forwarded, and so we can tell afterwards whether anything matched.
+	//
+	rawReporter, ferr := newReporter(*formatPtr, os.Stdout)
+	if ferr != nil {
+		fmt.Printf("error creating reporter: %s\n", ferr.Error())
+		return
+	}
+	reporter := newFilteringReporter(rawReporter, filter)
+
 	//
 	// Get the connection, using default creds
 	//
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String("eu-central-1"),
-	})
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("eu-central-1"))
 	if err != nil {
 		fmt.Printf("AWS login failed: %s\n", err.Error())
 		return
 	}
 
 	//
-	// Create a new session to find our account
+	// Find our account
 	//
-	stsSvc := sts.New(sess)
-	out, err := stsSvc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	stsSvc := sts.NewFromConfig(cfg)
+	out, err := stsSvc.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
 	if err != nil {
 		fmt.Printf("Failed to get identity: %s", err.Error())
 		return
 	}
 
-	acct := *out.Account
+	acct := aws.ToString(out.Account)
 
 	//
-	// If we have no role-list then just dump our current account
+	// If we have no role-list then just dump our current account,
+	// across the requested regions.
 	//
 	if *rolePtr == "" {
 
-		svc := ec2.New(sess)
+		regions, rerr := regionsForAccount(ctx, *regionsPtr, cfg)
+		if rerr != nil {
+			fmt.Printf("error resolving regions: %s\n", rerr.Error())
+			return
+		}
 
-		err := Sync(svc, acct)
-		if err != nil {
+		tasks := []scanTask{}
+		for _, region := range regions {
+			tasks = append(tasks, scanTask{
+				acct:   acct,
+				region: region,
+				cfg:    cfgForRegion(cfg, region),
+			})
+		}
+
+		if err := runPool(ctx, tasks, *parallelPtr, reporter, cache); err != nil {
 			fmt.Printf("error syncing account %s\n", err.Error())
-			return
+		}
+
+		if err := reporter.Flush(); err != nil {
+			fmt.Printf("error flushing report: %s\n", err.Error())
+		}
+
+		if err := cache.Save(); err != nil {
+			fmt.Printf("error saving AMI cache: %s\n", err.Error())
+		}
+
+		if *failOnMatchPtr && reporter.Matched() > 0 {
+			os.Exit(1)
 		}
 
 		return
@@ -216,48 +429,64 @@ func main() {
 	defer file.Close()
 
 	//
-	// Process the role-file line by line
+	// Parse the role-file into the roles it describes, then build up
+	// the set of (account, region) tasks to run through the worker
+	// pool - one per role, per region it should be scanned in.
 	//
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+	roles, err := parseRoleFile(file)
+	if err != nil {
+		fmt.Printf("Error processing role-file: %s %s\n", *rolePtr, err.Error())
+		return
+	}
 
-		// Get the line
-		role := scanner.Text()
+	tasks := []scanTask{}
+	for _, role := range roles {
 
-		// Skip comments
-		if strings.HasPrefix(role, "#") {
+		roleCfg, cerr := configForRole(ctx, cfg, role)
+		if cerr != nil {
+			fmt.Printf("error building credentials for role %s: %s\n", role.ARN, cerr.Error())
 			continue
 		}
 
-		// process
-		creds := stscreds.NewCredentials(sess, role)
-
-		// Create service client value configured for credentials
-		// from assumed role.
-		svc := ec2.New(sess, &aws.Config{Credentials: creds})
-
-		// We'll get the account from the string which looks like this:
-		//
-		// arn:aws:iam::1234:role/blah-abc
-		//
-		// We split by ":" and get the fourth field.
-		//
-		data := strings.Split(role, ":")
-		acct := data[4]
+		// A region set on the role-file row itself takes priority
+		// over the global `-regions` flag, since it's more specific.
+		var regions []string
+		var rerr error
+		if role.Region != "" {
+			regions = []string{role.Region}
+		} else {
+			regions, rerr = regionsForAccount(ctx, *regionsPtr, roleCfg)
+		}
+		if rerr != nil {
+			fmt.Printf("error resolving regions for role %s: %s\n", role.ARN, rerr.Error())
+			continue
+		}
 
-		// Process the running instances
-		err = Sync(svc, acct)
-		if err != nil {
-			fmt.Printf("Error for role %s %s\n", role, err.Error())
+		for _, region := range regions {
+			tasks = append(tasks, scanTask{
+				acct:   role.Account(),
+				region: region,
+				cfg:    cfgForRegion(roleCfg, region),
+			})
 		}
 	}
 
 	//
-	// Error processing the end of the file?
+	// Run every (account, region) task through the bounded worker pool.
 	//
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error processing role-file: %s %s\n", *rolePtr, err.Error())
-		return
+	if err := runPool(ctx, tasks, *parallelPtr, reporter, cache); err != nil {
+		fmt.Printf("Error processing roles: %s\n", err.Error())
+	}
+
+	if err := reporter.Flush(); err != nil {
+		fmt.Printf("error flushing report: %s\n", err.Error())
 	}
 
+	if err := cache.Save(); err != nil {
+		fmt.Printf("error saving AMI cache: %s\n", err.Error())
+	}
+
+	if *failOnMatchPtr && reporter.Matched() > 0 {
+		os.Exit(1)
+	}
 }
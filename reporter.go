@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Instance is a single EC2 instance record, in a form suitable for
+// structured output via a Reporter.
+type Instance struct {
+	Account         string
+	InstanceID      string
+	Name            string
+	AMI             string
+	AMICreationDate string
+	AMIAgeDays      int
+	Region          string
+	InstanceType    string
+	State           string
+	PrivateIP       string
+	PublicIP        string
+	LaunchTime      time.Time
+	Tags            map[string]string
+}
+
+// Reporter is implemented by anything which can emit a stream of
+// Instance records, in whatever output format it chooses.
+//
+// Report may be called concurrently, from the worker-pool in
+// runPool, so implementations are responsible for their own
+// synchronization.
+type Reporter interface {
+	Report(Instance) error
+}
+
+// Flusher is an optional interface a Reporter may implement when it
+// needs to buffer records and emit them all at once, e.g. to align
+// columns in tableReporter.
+type Flusher interface {
+	Flush() error
+}
+
+// newReporter constructs the Reporter named by `format`, writing to w.
+func newReporter(format string, w io.Writer) (Reporter, error) {
+	switch format {
+	case "", "text":
+		return &textReporter{w: w}, nil
+	case "json":
+		return &jsonReporter{w: w}, nil
+	case "csv":
+		return &csvReporter{w: csv.NewWriter(w)}, nil
+	case "table":
+		return &tableReporter{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// textReporter reproduces the original, space-separated output of Sync.
+type textReporter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (t *textReporter) Report(i Instance) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err := fmt.Fprintf(t.w, "%s %s %s %s %s %d days\n",
+		i.Account, i.Region, i.InstanceID, i.Name, i.AMI, i.AMIAgeDays)
+	return err
+}
+
+// jsonReporter emits one JSON object per instance, one per line, so
+// that output can be consumed by downstream tooling with a simple
+// line-oriented reader.
+type jsonReporter struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (j *jsonReporter) Report(i Instance) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return json.NewEncoder(j.w).Encode(i)
+}
+
+// csvReporter emits one CSV row per instance, writing the header on
+// the first call.
+type csvReporter struct {
+	w        *csv.Writer
+	lock     sync.Mutex
+	wroteHdr bool
+}
+
+var csvHeader = []string{
+	"Account", "InstanceID", "Name", "AMI", "AMICreationDate", "AMIAgeDays",
+	"Region", "InstanceType", "State", "PrivateIP", "PublicIP", "LaunchTime", "Tags",
+}
+
+func (c *csvReporter) Report(i Instance) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.wroteHdr {
+		if err := c.w.Write(csvHeader); err != nil {
+			return err
+		}
+		c.wroteHdr = true
+	}
+
+	row := []string{
+		i.Account, i.InstanceID, i.Name, i.AMI, i.AMICreationDate,
+		fmt.Sprintf("%d", i.AMIAgeDays), i.Region, i.InstanceType, i.State,
+		i.PrivateIP, i.PublicIP, i.LaunchTime.Format(time.RFC3339), tagsToString(i.Tags),
+	}
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvReporter) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// tableReporter buffers every instance it sees, so that Flush can
+// align all of the columns with a tabwriter.
+type tableReporter struct {
+	w    io.Writer
+	lock sync.Mutex
+	rows []Instance
+}
+
+func (t *tableReporter) Report(i Instance) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.rows = append(t.rows, i)
+	return nil
+}
+
+func (t *tableReporter) Flush() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	tw := tabwriter.NewWriter(t.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACCOUNT\tREGION\tINSTANCE\tNAME\tAMI\tAGE\tSTATE\tPRIVATE IP\tPUBLIC IP")
+	for _, i := range t.rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d days\t%s\t%s\t%s\n",
+			i.Account, i.Region, i.InstanceID, i.Name, i.AMI, i.AMIAgeDays,
+			i.State, i.PrivateIP, i.PublicIP)
+	}
+	return tw.Flush()
+}
+
+// tagsToString flattens a tag-map into a single "k=v,k=v" field, so
+// it can fit into a single CSV column.
+func tagsToString(tags map[string]string) string {
+	out := ""
+	for k, v := range tags {
+		if out != "" {
+			out += ","
+		}
+		out += k + "=" + v
+	}
+	return out
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"io"
+	"strings"
+)
+
+// Role describes a single entry in a role-file: an ARN to assume,
+// plus whatever per-role overrides were supplied alongside it.
+//
+// The role-file is TSV, one role per line:
+//
+//	arn<TAB>region<TAB>external_id<TAB>mfa_serial<TAB>session_name<TAB>profile
+//
+// Only the ARN is required; trailing columns may be omitted, so a
+// plain "one ARN per line" file (the original format) still works.
+type Role struct {
+	ARN         string
+	Region      string
+	ExternalID  string
+	MFASerial   string
+	SessionName string
+	Profile     string
+}
+
+// Account returns the account-id embedded in the role's ARN, e.g.
+// "1234" from "arn:aws:iam::1234:role/blah-abc".
+func (r Role) Account() string {
+	data := strings.Split(r.ARN, ":")
+	if len(data) > 4 {
+		return data[4]
+	}
+	return r.ARN
+}
+
+// parseRoleLine turns a single TSV line from a role-file into a Role.
+func parseRoleLine(line string) Role {
+
+	fields := strings.Split(line, "\t")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	role := Role{ARN: fields[0]}
+	if len(fields) > 1 {
+		role.Region = fields[1]
+	}
+	if len(fields) > 2 {
+		role.ExternalID = fields[2]
+	}
+	if len(fields) > 3 {
+		role.MFASerial = fields[3]
+	}
+	if len(fields) > 4 {
+		role.SessionName = fields[4]
+	}
+	if len(fields) > 5 {
+		role.Profile = fields[5]
+	}
+	return role
+}
+
+// parseRoleFile reads a role-file, skipping blank lines and lines
+// beginning with "#", and returns the Role for each remaining line.
+func parseRoleFile(r io.Reader) ([]Role, error) {
+
+	roles := []Role{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		roles = append(roles, parseRoleLine(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// configForRole builds an aws.Config which assumes the given Role,
+// on top of either the base config or, if the role specifies one, a
+// config loaded from a named source profile. It supports an STS
+// ExternalId and, if an MFA serial is supplied, prompts on stdin for
+// the current token code.
+func configForRole(ctx context.Context, base aws.Config, role Role) (aws.Config, error) {
+
+	source := base
+	if role.Profile != "" {
+		profileCfg, err := config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(role.Profile))
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("error loading profile %s: %s", role.Profile, err)
+		}
+		source = profileCfg
+	}
+
+	stsClient := sts.NewFromConfig(source)
+
+	provider := stscreds.NewAssumeRoleProvider(stsClient, role.ARN, func(o *stscreds.AssumeRoleOptions) {
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+		if role.SessionName != "" {
+			o.RoleSessionName = role.SessionName
+		}
+		if role.MFASerial != "" {
+			o.SerialNumber = aws.String(role.MFASerial)
+			o.TokenProvider = stscreds.StdinTokenProvider
+		}
+	})
+
+	roleCfg := source.Copy()
+	roleCfg.Credentials = aws.NewCredentialsCache(provider)
+	if role.Region != "" {
+		roleCfg.Region = role.Region
+	}
+	return roleCfg, nil
+}